@@ -0,0 +1,286 @@
+package gcreds4aws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"google.golang.org/api/option"
+)
+
+// CredentialSourceLoader fetches the raw (possibly base64-encoded)
+// credentials JSON referenced by an ARN. It mirrors the executable/file/url
+// credential source extension points the oauth2 externalaccount package
+// offers, but for where gcreds4aws itself resolves the service-account JSON
+// from: SSM Parameter Store, Secrets Manager, S3, KMS-encrypted blobs, or any
+// backend a caller registers with SetCredentialSourceLoader.
+type CredentialSourceLoader interface {
+	LoadCredentialSource(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error)
+}
+
+// CredentialSourceLoaderFunc adapts a plain function to a CredentialSourceLoader.
+type CredentialSourceLoaderFunc func(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error)
+
+func (f CredentialSourceLoaderFunc) LoadCredentialSource(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error) {
+	return f(ctx, mgr, arnObj)
+}
+
+// SetCredentialSourceLoader registers loader on the DefaultCredentialsManager
+// for the given ARN service name (e.g. "ssm", "secretsmanager", "s3", "kms",
+// or a custom scheme such as "vault").
+func SetCredentialSourceLoader(service string, loader CredentialSourceLoader) {
+	DefaultCredentialsManager.SetCredentialSourceLoader(service, loader)
+}
+
+// SetCredentialSourceLoader registers loader for the given ARN service name,
+// overriding the built-in loader if one is already registered for it.
+func (mgr *CredentialsManager) SetCredentialSourceLoader(service string, loader CredentialSourceLoader) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.credentialSourceLoaders == nil {
+		mgr.credentialSourceLoaders = defaultCredentialSourceLoaders()
+	}
+	mgr.credentialSourceLoaders[service] = loader
+}
+
+func (mgr *CredentialsManager) getCredentialSourceLoader(service string) (CredentialSourceLoader, bool) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.credentialSourceLoaders == nil {
+		mgr.credentialSourceLoaders = defaultCredentialSourceLoaders()
+	}
+	loader, ok := mgr.credentialSourceLoaders[service]
+	return loader, ok
+}
+
+func defaultCredentialSourceLoaders() map[string]CredentialSourceLoader {
+	return map[string]CredentialSourceLoader{
+		"ssm":            CredentialSourceLoaderFunc(loadCredentialSourceFromSSM),
+		"secretsmanager": CredentialSourceLoaderFunc(loadCredentialSourceFromSecretsManager),
+		"s3":             CredentialSourceLoaderFunc(loadCredentialSourceFromS3),
+		"kms":            CredentialSourceLoaderFunc(loadCredentialSourceFromKMS),
+	}
+}
+
+func (mgr *CredentialsManager) newCredentialsOptionFromArn(ctx context.Context, rawARN string) (option.ClientOption, error) {
+	arnObj, err := arn.Parse(rawARN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ARN: %w", err)
+	}
+	loader, ok := mgr.getCredentialSourceLoader(arnObj.Service)
+	if !ok {
+		return nil, fmt.Errorf("unsupported service: %s", arnObj.Service)
+	}
+	bs, err := loader.LoadCredentialSource(ctx, mgr, arnObj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credential source from %s: %w", arnObj.Service, err)
+	}
+	return mgr.newCredentialsOptionFromBytes(ctx, bs)
+}
+
+func loadCredentialSourceFromSSM(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error) {
+	client, err := mgr.getSSMClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(arnObj.Resource, "/")
+	if len(parts) > 1 && parts[0] == "parameter" {
+		parts = parts[1:]
+	}
+	if len(parts) == 0 {
+		return nil, errors.New("invalid ARN: resource is empty")
+	}
+	var name string
+	if len(parts) == 1 {
+		name = parts[0]
+	} else {
+		name = "/" + strings.Join(parts, "/")
+	}
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parameter: %w", err)
+	}
+	return []byte(*output.Parameter.Value), nil
+}
+
+// GetSecretValueAPIClient is the subset of the Secrets Manager client used to
+// load credentials stored as a secret value.
+type GetSecretValueAPIClient interface {
+	GetSecretValue(ctx context.Context, input *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// SetSecretsManagerClient overrides the Secrets Manager client used by the
+// DefaultCredentialsManager's built-in "secretsmanager" loader.
+func SetSecretsManagerClient(client GetSecretValueAPIClient) {
+	DefaultCredentialsManager.SetSecretsManagerClient(client)
+}
+
+func (mgr *CredentialsManager) SetSecretsManagerClient(client GetSecretValueAPIClient) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.secretsManagerClient = client
+}
+
+func (mgr *CredentialsManager) getSecretsManagerClient(ctx context.Context) (GetSecretValueAPIClient, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.secretsManagerClient != nil {
+		return mgr.secretsManagerClient, nil
+	}
+	cfg, err := mgr.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := secretsmanager.NewFromConfig(cfg)
+	mgr.secretsManagerClient = client
+	return client, nil
+}
+
+func loadCredentialSourceFromSecretsManager(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error) {
+	client, err := mgr.getSecretsManagerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(arnObj.String()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret value: %w", err)
+	}
+	if output.SecretString != nil {
+		return []byte(*output.SecretString), nil
+	}
+	return output.SecretBinary, nil
+}
+
+// GetObjectAPIClient is the subset of the S3 client used to load credentials
+// stored as an object.
+type GetObjectAPIClient interface {
+	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// SetS3Client overrides the S3 client used by the DefaultCredentialsManager's
+// built-in "s3" loader.
+func SetS3Client(client GetObjectAPIClient) {
+	DefaultCredentialsManager.SetS3Client(client)
+}
+
+func (mgr *CredentialsManager) SetS3Client(client GetObjectAPIClient) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.s3Client = client
+}
+
+func (mgr *CredentialsManager) getS3Client(ctx context.Context) (GetObjectAPIClient, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.s3Client != nil {
+		return mgr.s3Client, nil
+	}
+	cfg, err := mgr.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg)
+	mgr.s3Client = client
+	return client, nil
+}
+
+// loadCredentialSourceFromS3 expects an ARN of the form
+// "arn:aws:s3:::bucket/key".
+func loadCredentialSourceFromS3(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error) {
+	client, err := mgr.getS3Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(arnObj.Resource, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("invalid ARN: expected bucket/key resource")
+	}
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(parts[0]),
+		Key:    aws.String(parts[1]),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer output.Body.Close()
+	bs, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object body: %w", err)
+	}
+	return bs, nil
+}
+
+// DecryptAPIClient is the subset of the KMS client used to decrypt a
+// client-side encrypted credentials blob.
+type DecryptAPIClient interface {
+	Decrypt(ctx context.Context, input *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// SetKMSClient overrides the KMS client used by the DefaultCredentialsManager's
+// built-in "kms" loader.
+func SetKMSClient(client DecryptAPIClient) {
+	DefaultCredentialsManager.SetKMSClient(client)
+}
+
+func (mgr *CredentialsManager) SetKMSClient(client DecryptAPIClient) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.kmsClient = client
+}
+
+func (mgr *CredentialsManager) getKMSClient(ctx context.Context) (DecryptAPIClient, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.kmsClient != nil {
+		return mgr.kmsClient, nil
+	}
+	cfg, err := mgr.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := kms.NewFromConfig(cfg)
+	mgr.kmsClient = client
+	return client, nil
+}
+
+// loadCredentialSourceFromKMS expects an ARN of the form
+// "arn:aws:kms:<region>:<account>:key/<key-id>/<base64-ciphertext>": the
+// credentials JSON encrypted client-side with the referenced KMS key, so it
+// can be committed or stored alongside config without a separate secret store.
+func loadCredentialSourceFromKMS(ctx context.Context, mgr *CredentialsManager, arnObj arn.ARN) ([]byte, error) {
+	client, err := mgr.getKMSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(arnObj.Resource, "/", 3)
+	if len(parts) != 3 || parts[0] != "key" {
+		return nil, errors.New("invalid ARN: expected key/<key-id>/<base64-ciphertext> resource")
+	}
+	keyID, ciphertextB64 := parts[1], parts[2]
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextB64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	output, err := client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(fmt.Sprintf("arn:%s:kms:%s:%s:key/%s", arnObj.Partition, arnObj.Region, arnObj.AccountID, keyID)),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+	return output.Plaintext, nil
+}
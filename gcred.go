@@ -17,9 +17,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/option"
 )
 
@@ -57,6 +57,21 @@ type CredentialsManager struct {
 	proxyListener             net.Listener
 	proxyRegion               string
 	proxyWaitGroup            sync.WaitGroup
+	proxyBasePath             string
+	proxyUnixSocketPath       string
+	proxyAllowIMDSv1          bool
+	imdsTokens                map[string]time.Time
+	universeDomain            string
+	awsCredentialsSupplier    AWSCredentialsSupplierFunc
+	credentialSourceLoaders   map[string]CredentialSourceLoader
+	secretsManagerClient      GetSecretValueAPIClient
+	s3Client                  GetObjectAPIClient
+	kmsClient                 DecryptAPIClient
+	refreshWindow             time.Duration
+	maxCacheLifetime          time.Duration
+	refreshOnce               sync.Once
+	refreshStop               chan struct{}
+	sfGroup                   singleflight.Group
 }
 
 const (
@@ -68,6 +83,10 @@ const (
 func (mgr *CredentialsManager) Close() error {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
+	if mgr.refreshStop != nil {
+		close(mgr.refreshStop)
+		mgr.refreshStop = nil
+	}
 	if mgr.proxyServer == nil {
 		return nil
 	}
@@ -122,15 +141,54 @@ func (mgr *CredentialsManager) WithCredentials(ctx context.Context) option.Clien
 	return opt
 }
 
+// NewCredentialsOption returns an option.ClientOption backed by GCP
+// credentials derived from the ambient AWS identity. Concurrent calls that
+// miss the cache are collapsed into a single fetch via sfGroup, so a cache
+// expiry under load triggers at most one credential lookup (the environment,
+// or the backend an ARN names, such as SSM). The STS exchange and
+// impersonation are not part of that fetch: they happen later, when a client
+// built from the returned option first requests a token.
 func (mgr *CredentialsManager) NewCredentialsOption(ctx context.Context) (option.ClientOption, error) {
+	ctx, span := tracer.Start(ctx, "gcreds4aws.NewCredentialsOption")
+	defer span.End()
 	logger := mgr.getLogger()
-	if opt, ok := mgr.newCredentialsOptionFromCache(); ok {
+	if opt, ok, err := mgr.newCredentialsOptionFromCache(ctx); ok {
+		cacheHitCounter.Add(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
 		logger.DebugContext(ctx, "use cached credentials")
 		return opt, nil
 	}
+	cacheMissCounter.Add(ctx, 1)
+	opt, err, _ := mgr.sfGroup.Do("credentials", func() (any, error) {
+		return mgr.fetchCredentialsOption(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return opt.(option.ClientOption), nil
+}
+
+func (mgr *CredentialsManager) fetchCredentialsOption(ctx context.Context) (option.ClientOption, error) {
+	if opt, ok, err := mgr.newCredentialsOptionFromCache(ctx); ok {
+		return opt, err
+	}
+	return mgr.resolveCredentialsOption(ctx)
+}
+
+// resolveCredentialsOption always does the real env/ARN-driven lookup,
+// ignoring whatever is cached. fetchCredentialsOption (the cache-miss path)
+// and the background refresher (which must force a real fetch ahead of
+// expiry, not just replay the still-valid cache entry) both funnel through
+// here.
+func (mgr *CredentialsManager) resolveCredentialsOption(ctx context.Context) (option.ClientOption, error) {
 	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
 		return mgr.newCredentialsOptionFromPath(ctx, path)
 	}
+	if workforcePoolID := os.Getenv("GOOGLE_CLOUD_WORKFORCE_POOL_ID"); workforcePoolID != "" {
+		return mgr.newWorkforceCredentialsOption(ctx, workforcePoolID)
+	}
 	projectNumberStr := os.Getenv("GOOGLE_CLOUD_PROJECT_NUMBER")
 	poolID := os.Getenv("GOOGLE_CLOUD_POOL_ID")
 	providerID := os.Getenv("GOOGLE_CLOUD_PROVIDER_ID")
@@ -146,10 +204,10 @@ func (mgr *CredentialsManager) NewCredentialsOption(ctx context.Context) (option
 
 	cred := &credentials{
 		Type:                           "external_account",
-		Audience:                       fmt.Sprintf("//iam.googleapis.com/projects/%d/locations/global/workloadIdentityPools/%s/providers/%s", projectNumber, poolID, providerID),
+		Audience:                       fmt.Sprintf("//iam.%s/projects/%d/locations/global/workloadIdentityPools/%s/providers/%s", mgr.getUniverseDomain(), projectNumber, poolID, providerID),
 		SubjectTokenType:               SubjectTokenTypeForAWS,
-		ServiceAccountImpersonationURL: fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", serviceAccountEmail),
-		TokenURL:                       "https://sts.googleapis.com/v1/token",
+		ServiceAccountImpersonationURL: mgr.serviceAccountImpersonationURL(serviceAccountEmail),
+		TokenURL:                       mgr.stsTokenURL(),
 	}
 	bs, err := json.Marshal(cred)
 	if err != nil {
@@ -169,19 +227,6 @@ func (mgr *CredentialsManager) newCredentialsOptionFromPath(ctx context.Context,
 	return mgr.newCredentialsOptionFromBytes(ctx, bs)
 }
 
-func (mgr *CredentialsManager) newCredentialsOptionFromArn(ctx context.Context, rawARN string) (option.ClientOption, error) {
-	arnObj, err := arn.Parse(rawARN)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse ARN: %w", err)
-	}
-	switch arnObj.Service {
-	case "ssm":
-		return mgr.newCredentialsOptionFromSSM(ctx, arnObj)
-	default:
-		return nil, fmt.Errorf("unsupported service: %s", arnObj.Service)
-	}
-}
-
 func (mgr *CredentialsManager) loadConfig(ctx context.Context) (aws.Config, error) {
 
 	if mgr.awsCfg != nil {
@@ -210,49 +255,32 @@ func (mgr *CredentialsManager) getSSMClient(ctx context.Context) (GetParameterAP
 	return client, nil
 }
 
-func (mgr *CredentialsManager) newCredentialsOptionFromCache() (option.ClientOption, bool) {
-	if bs, cred, ok := mgr.getCachedCredentials(); ok {
-		return option.WithAuthCredentialsJSON(cred.credentialsType(), bs), true
-	}
-	return nil, false
-}
-
-func (mgr *CredentialsManager) newCredentialsOptionFromSSM(ctx context.Context, arnObj arn.ARN) (option.ClientOption, error) {
-	client, err := mgr.getSSMClient(ctx)
-	if err != nil {
-		return nil, err
-	}
-	parts := strings.Split(arnObj.Resource, "/")
-	if len(parts) > 1 && parts[0] == "parameter" {
-		parts = parts[1:]
-	}
-	if len(parts) == 0 {
-		return nil, errors.New("invalid ARN: resource is empty")
-	}
-	var name string
-	if len(parts) == 1 {
-		name = parts[0]
-	} else {
-		name = "/" + strings.Join(parts, "/")
-	}
-	input := &ssm.GetParameterInput{
-		Name:           aws.String(name),
-		WithDecryption: aws.Bool(true),
-	}
-	output, err := client.GetParameter(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get parameter: %w", err)
-	}
-	return mgr.newCredentialsOptionFromBytes(ctx, []byte(*output.Parameter.Value))
+// newCredentialsOptionFromCache returns the cached credential as a ClientOption.
+// The AWS credentials supplier path (SetAWSCredentialsSupplier) never caches a
+// usable JSON credential_source - an AwsSecurityCredentialsSupplier can't be
+// expressed in JSON - so on every cache hit for that path it rebuilds the
+// externalaccount token source from the cached credentials struct instead of
+// replaying the raw bytes through option.WithAuthCredentialsJSON.
+func (mgr *CredentialsManager) newCredentialsOptionFromCache(ctx context.Context) (option.ClientOption, bool, error) {
+	bs, cred, ok := mgr.getCachedCredentials()
+	if !ok {
+		return nil, false, nil
+	}
+	if mgr.hasAWSCredentialsSupplier() && cred.SubjectTokenType == SubjectTokenTypeForAWS {
+		opt, err := mgr.newCredentialsOptionFromSupplier(ctx, cred)
+		return opt, true, err
+	}
+	return option.WithAuthCredentialsJSON(cred.credentialsType(), bs), true, nil
 }
 
 type credentials struct {
 	Type                           string            `json:"type"`
 	Audience                       string            `json:"audience"`
 	SubjectTokenType               string            `json:"subject_token_type"`
-	ServiceAccountImpersonationURL string            `json:"service_account_impersonation_url"`
+	ServiceAccountImpersonationURL string            `json:"service_account_impersonation_url,omitempty"`
 	TokenURL                       string            `json:"token_url"`
 	CredentialSource               *credentialSource `json:"credential_source,omitempty"`
+	WorkforcePoolUserProject       string            `json:"workforce_pool_user_project,omitempty"`
 }
 
 type credentialSource struct {
@@ -282,7 +310,7 @@ func (cred *credentials) credentialsType() option.CredentialsType {
 	}
 }
 
-func (mgr *CredentialsManager) newCredentialsOptionFromBytes(_ context.Context, bs []byte) (option.ClientOption, error) {
+func (mgr *CredentialsManager) newCredentialsOptionFromBytes(ctx context.Context, bs []byte) (option.ClientOption, error) {
 	if len(bs) == 0 {
 		return nil, errors.New("empty credentials")
 	}
@@ -300,6 +328,10 @@ func (mgr *CredentialsManager) newCredentialsOptionFromBytes(_ context.Context,
 		mgr.setCredentialsCache(bs, &creds)
 		return option.WithAuthCredentialsJSON(creds.credentialsType(), bs), nil
 	}
+	if mgr.hasAWSCredentialsSupplier() && creds.SubjectTokenType == SubjectTokenTypeForAWS {
+		mgr.setCredentialsCache(bs, &creds)
+		return mgr.newCredentialsOptionFromSupplier(ctx, &creds)
+	}
 	rewrited, err := mgr.rewriteCredentialSource(&creds)
 	if err != nil {
 		return nil, fmt.Errorf("failed to rewrite credential source: %w", err)
@@ -312,116 +344,13 @@ func (mgr *CredentialsManager) newCredentialsOptionFromBytes(_ context.Context,
 	return option.WithAuthCredentialsJSON(rewrited.credentialsType(), bs), nil
 }
 
-func (mgr *CredentialsManager) rewriteCredentialSource(cred *credentials) (*credentials, error) {
-	// check from AWS Credential Source
-	if cred.SubjectTokenType != SubjectTokenTypeForAWS {
-		return cred, nil
-	}
-	if cred.CredentialSource != nil && cred.CredentialSource.File != "" {
-		return cred, nil
-	}
-
-	addr, err := mgr.getProxyServerAddress()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get proxy server address: %w", err)
-	}
-	if cred.CredentialSource == nil {
-		cred.CredentialSource = &credentialSource{
-			EnvironmentID: "aws1",
-		}
-	}
-	cred.CredentialSource.URL = fmt.Sprintf("http://%s%s", addr, credentialsPath)
-	cred.CredentialSource.RegionURL = fmt.Sprintf("http://%s%s", addr, regionPath)
-	cred.CredentialSource.RegionalCredVerificationURL = "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15"
-	return cred, nil
-}
-
-const (
-	regionPath      = "/latest/meta-data/placement/availability-zone"
-	credentialsPath = "/latest/meta-data/iam/security-credentials"
-)
-
-func (mgr *CredentialsManager) getProxyServerAddress() (string, error) {
-	mgr.mu.Lock()
-	defer mgr.mu.Unlock()
-	if mgr.proxyServer == nil {
-		listener, err := net.Listen("tcp", ":0")
-		if err != nil {
-			return "", fmt.Errorf("failed to listen: %w", err)
-		}
-		mgr.proxyListener = listener
-		if region := os.Getenv("AWS_REGION"); region != "" {
-			mgr.proxyRegion = region
-		} else if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
-			mgr.proxyRegion = region
-		} else {
-			mgr.proxyRegion = "us-east-1"
-		}
-		m := http.NewServeMux()
-		m.HandleFunc(regionPath, func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(mgr.proxyRegion))
-		})
-		m.HandleFunc(credentialsPath, func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("default"))
-		})
-		m.HandleFunc(credentialsPath+"/default", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			mgr.mu.Lock()
-			defer mgr.mu.Unlock()
-			awsCfg, err := mgr.loadConfig(r.Context())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, `{"Code": "Failed", "Message": "%s"}`, err.Error())
-				return
-			}
-			cloned := awsCfg.Copy()
-			cloned.Region = mgr.proxyRegion
-			cred, err := cloned.Credentials.Retrieve(r.Context())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, `{"Code": "Failed", "Message": "%s"}`, err.Error())
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w,
-				`{"Code": "Success", "LastUpdated":"%s", "Type": "AWS-HMAC", "AccessKeyId": "%s", "SecretAccessKey": "%s", "Token": "%s", "Expiration": "%s"}`,
-				time.Now().Format(time.RFC3339),
-				cred.AccessKeyID,
-				cred.SecretAccessKey,
-				cred.SessionToken,
-				cred.Expires.Format(time.RFC3339),
-			)
-		})
-		mgr.proxyServer = &http.Server{
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				logger := mgr.getLogger()
-				logger.Debug("receive request on credentials proxy server", "method", r.Method, "url", r.URL, "remote_addr", r.RemoteAddr)
-				m.ServeHTTP(w, r)
-			}),
-		}
-		mgr.proxyWaitGroup = sync.WaitGroup{}
-		mgr.proxyWaitGroup.Add(1)
-		go func() {
-			logger := mgr.getLogger()
-			logger.Info("start credentials proxy server", "addr", listener.Addr())
-			if err := mgr.proxyServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				logger.Error("failed to serve credentials proxy server", "error", err)
-			}
-			mgr.proxyWaitGroup.Done()
-		}()
-	}
-	port := mgr.proxyListener.Addr().(*net.TCPAddr).Port
-	return fmt.Sprintf("127.0.0.1:%d", port), nil
-}
-
 func (mgr *CredentialsManager) setCredentialsCache(bs []byte, cred *credentials) {
 	mgr.mu.Lock()
-	defer mgr.mu.Unlock()
 	mgr.cacheCredentialsJSON = bs
 	mgr.cacheCredentials = cred
-	mgr.cacheCredentialsExpiresAt = time.Now().Add(CacheLifetimeSeconds * time.Second)
+	mgr.cacheCredentialsExpiresAt = time.Now().Add(mgr.getMaxCacheLifetimeLocked())
+	mgr.mu.Unlock()
+	mgr.startBackgroundRefresher()
 }
 
 func (mgr *CredentialsManager) getCachedCredentials() ([]byte, *credentials, bool) {
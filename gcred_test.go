@@ -2,9 +2,15 @@ package gcreds4aws
 
 import (
 	"context"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/stretchr/testify/mock"
@@ -41,3 +47,205 @@ func TestNewCredentialsOptionWithSSM(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, opt)
 }
+
+type MockSecretsManagerClient struct {
+	mock.Mock
+}
+
+func (m *MockSecretsManagerClient) GetSecretValue(ctx context.Context, input *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	args := m.Called(ctx, input)
+	return args.Get(0).(*secretsmanager.GetSecretValueOutput), args.Error(1)
+}
+
+func TestNewCredentialsOptionWithSecretsManager(t *testing.T) {
+	mockClient := new(MockSecretsManagerClient)
+	mockClient.On("GetSecretValue", mock.Anything, mock.MatchedBy(
+		func(input *secretsmanager.GetSecretValueInput) bool {
+			return *input.SecretId == "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret"
+		},
+	)).Return(&secretsmanager.GetSecretValueOutput{
+		SecretString: aws.String(`{"type":"external_account","audience":"//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider","subject_token_type":"urn:ietf:params:aws:token-type:aws4_request","service_account_impersonation_url":"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account-email:generateAccessToken","token_url":"https://sts.googleapis.com/v1/token"}`),
+	}, nil)
+
+	// A fresh manager, so the credentials the SSM test cached on
+	// DefaultCredentialsManager don't satisfy this call without ever reaching
+	// the Secrets Manager loader.
+	mgr := &CredentialsManager{}
+	mgr.SetSecretsManagerClient(mockClient)
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "arn:aws:secretsmanager:us-east-1:123456789012:secret:test-secret")
+
+	ctx := context.Background()
+	opt, err := mgr.NewCredentialsOption(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, opt)
+}
+
+func TestNewCredentialsOptionWithWorkforcePool(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetAWSCredentialsSupplier(func(ctx context.Context) (string, string, string, string, error) {
+		return "AKIAEXAMPLE", "secret", "token", "ap-northeast-1", nil
+	})
+
+	t.Setenv("GOOGLE_CLOUD_WORKFORCE_POOL_ID", "pool")
+	t.Setenv("GOOGLE_CLOUD_WORKFORCE_PROVIDER_ID", "provider")
+
+	ctx := context.Background()
+	opt, err := mgr.NewCredentialsOption(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, opt)
+}
+
+func TestBackgroundRefresherStartsAfterFirstFetch(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetMaxCacheLifetime(50 * time.Millisecond)
+	mgr.SetRefreshWindow(40 * time.Millisecond)
+
+	mgr.SetAWSCredentialsSupplier(func(ctx context.Context) (string, string, string, string, error) {
+		return "AKIAEXAMPLE", "secret", "token", "ap-northeast-1", nil
+	})
+
+	// The supplier itself only runs when a token is requested, which nothing
+	// here does, so count lookups of the credential source instead: each one
+	// is a real fetch rather than a replay of the cache.
+	var calls int32
+	mgr.SetCredentialSourceLoader("ssm", CredentialSourceLoaderFunc(func(ctx context.Context, _ *CredentialsManager, _ arn.ARN) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte(`{"type":"external_account","audience":"//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider","subject_token_type":"urn:ietf:params:aws:token-type:aws4_request","service_account_impersonation_url":"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account-email:generateAccessToken","token_url":"https://sts.googleapis.com/v1/token"}`), nil
+	}))
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "arn:aws:ssm:us-east-1:123456789012:parameter/test-parameter")
+
+	ctx := context.Background()
+	_, err := mgr.NewCredentialsOption(ctx)
+	require.NoError(t, err)
+
+	mgr.mu.Lock()
+	started := mgr.refreshStop != nil
+	mgr.mu.Unlock()
+	require.True(t, started, "background refresher must start after the first successful fetch")
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) >= 2
+	}, time.Second, 5*time.Millisecond, "background refresher must perform a real fetch ahead of expiry, not just replay the cached value")
+
+	require.NoError(t, mgr.Close())
+}
+
+func TestIMDSv2RequiresValidTokenOnceIssued(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetProxyBasePath("/internal")
+
+	addr, err := mgr.getProxyServerAddress()
+	require.NoError(t, err)
+	defer mgr.Close()
+
+	baseURL := "http://" + addr + "/internal"
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+regionPath, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode, "IMDSv1 requests without a token must be rejected by default")
+
+	tokenReq, err := http.NewRequest(http.MethodPut, baseURL+tokenPath, nil)
+	require.NoError(t, err)
+	tokenReq.Header.Set(tokenTTLHeader, "21600")
+	tokenResp, err := http.DefaultClient.Do(tokenReq)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, tokenResp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodGet, baseURL+regionPath, nil)
+	require.NoError(t, err)
+	req.Header.Set(tokenHeader, "not-a-real-token")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode, "an unrecognized token must be rejected")
+}
+
+func TestIMDSv1FallbackRequiresOptIn(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetProxyBasePath("/internal")
+	mgr.SetProxyAllowIMDSv1(true)
+
+	addr, err := mgr.getProxyServerAddress()
+	require.NoError(t, err)
+	defer mgr.Close()
+
+	baseURL := "http://" + addr + "/internal"
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+regionPath, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "tokenless requests must be accepted once IMDSv1 fallback is opted into")
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetProxyBasePath("/internal")
+	mgr.SetProxyUnixSocketPath(filepath.Join(t.TempDir(), "gcreds4aws.sock"))
+	mgr.SetProxyAllowIMDSv1(true)
+
+	client, err := mgr.ProxyHTTPClient()
+	require.NoError(t, err)
+	defer mgr.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://unix/internal"+regionPath, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "the proxy must be reachable over its Unix domain socket")
+}
+
+func TestNewCredentialsOptionsWithUniverseDomain(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetUniverseDomain("example-tpc.goog")
+	mgr.SetAWSCredentialsSupplier(func(ctx context.Context) (string, string, string, string, error) {
+		return "AKIAEXAMPLE", "secret", "token", "ap-northeast-1", nil
+	})
+
+	t.Setenv("GOOGLE_CLOUD_PROJECT_NUMBER", "123")
+	t.Setenv("GOOGLE_CLOUD_POOL_ID", "pool")
+	t.Setenv("GOOGLE_CLOUD_PROVIDER_ID", "provider")
+	t.Setenv("GOOGLE_CLOUD_SERVICE_ACCOUNT_EMAIL", "service-account-email")
+
+	require.Equal(t, "https://sts.example-tpc.goog/v1/token", mgr.stsTokenURL())
+
+	ctx := context.Background()
+	opts, err := mgr.NewCredentialsOptions(ctx)
+	require.NoError(t, err)
+	require.Len(t, opts, 2)
+}
+
+func TestNewCredentialsOptionWithAWSCredentialsSupplier(t *testing.T) {
+	mgr := &CredentialsManager{}
+	mgr.SetAWSCredentialsSupplier(func(ctx context.Context) (string, string, string, string, error) {
+		return "AKIAEXAMPLE", "secret", "token", "ap-northeast-1", nil
+	})
+
+	t.Setenv("GOOGLE_CLOUD_PROJECT_NUMBER", "123")
+	t.Setenv("GOOGLE_CLOUD_POOL_ID", "pool")
+	t.Setenv("GOOGLE_CLOUD_PROVIDER_ID", "provider")
+	t.Setenv("GOOGLE_CLOUD_SERVICE_ACCOUNT_EMAIL", "service-account-email")
+
+	ctx := context.Background()
+	opt, err := mgr.NewCredentialsOption(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, opt)
+	require.Nil(t, mgr.proxyServer, "supplier path must not start the IMDS proxy")
+
+	// The cached credential has no credential_source (a supplier can't be
+	// expressed in JSON), so a second call within the cache lifetime must
+	// rebuild the token source from the supplier rather than replaying the
+	// cached JSON via option.WithAuthCredentialsJSON, which would produce an
+	// external_account credential with no way to ever obtain a subject token.
+	_, cred, ok := mgr.getCachedCredentials()
+	require.True(t, ok)
+	require.Nil(t, cred.CredentialSource)
+
+	opt2, ok, err := mgr.newCredentialsOptionFromCache(ctx)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.NotNil(t, opt2)
+}
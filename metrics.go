@@ -0,0 +1,80 @@
+package gcreds4aws
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/option"
+)
+
+var moduleVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/mashiike/gcreds4aws" {
+			return dep.Version
+		}
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "unknown"
+})
+
+// WithMetricsHeader returns a ClientOption that attaches an x-goog-api-client
+// header identifying gcreds4aws as the BYOID credential source to every
+// outgoing request, following the BYOID metrics header convention. It is
+// built on option.WithHTTPClient, which takes precedence over every other
+// ClientOption given to a Google SDK client constructor, so a client given
+// both this and WithCredentials sends its requests through this client
+// without the gcreds4aws credentials.
+func WithMetricsHeader() option.ClientOption {
+	return DefaultCredentialsManager.WithMetricsHeader()
+}
+
+// WithMetricsHeader builds the metrics-header ClientOption for this manager.
+// Since gcreds4aws doesn't own the HTTP client the oauth2/externalaccount
+// machinery uses internally, this wraps option.WithHTTPClient with a
+// RoundTripper that injects the header on every outgoing call instead.
+func (mgr *CredentialsManager) WithMetricsHeader() option.ClientOption {
+	mgr.mu.Lock()
+	saImpersonation := mgr.cacheCredentials != nil && mgr.cacheCredentials.ServiceAccountImpersonationURL != ""
+	mgr.mu.Unlock()
+	return option.WithHTTPClient(&http.Client{
+		Transport: &metricsRoundTripper{
+			header: mgr.metricsHeader(saImpersonation),
+			base:   http.DefaultTransport,
+		},
+	})
+}
+
+func (mgr *CredentialsManager) metricsHeader(saImpersonation bool) string {
+	return fmt.Sprintf(
+		"gl-go/%s auth/%s google-byoid-sdk source/aws sa-impersonation/%t config-lifetime/%d",
+		strings.TrimPrefix(runtime.Version(), "go"),
+		moduleVersion(),
+		saImpersonation,
+		int(mgr.getMaxCacheLifetime().Seconds()),
+	)
+}
+
+type metricsRoundTripper struct {
+	header string
+	base   http.RoundTripper
+}
+
+func (rt *metricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("x-goog-api-client", rt.header)
+	base := rt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
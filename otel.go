@@ -0,0 +1,21 @@
+package gcreds4aws
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// instrumentationName identifies this package's spans and metrics to
+// whatever OpenTelemetry SDK the host application has configured. gcreds4aws
+// never configures a global provider itself; if the application hasn't, the
+// calls below are no-ops.
+const instrumentationName = "github.com/mashiike/gcreds4aws"
+
+var (
+	tracer = otel.Tracer(instrumentationName)
+	meter  = otel.Meter(instrumentationName)
+
+	cacheHitCounter, _  = meter.Int64Counter("gcreds4aws.credentials.cache_hits", metric.WithDescription("NewCredentialsOption calls served from the in-memory cache"))
+	cacheMissCounter, _ = meter.Int64Counter("gcreds4aws.credentials.cache_misses", metric.WithDescription("NewCredentialsOption calls that required a fresh STS/impersonation fetch"))
+	proxyHitCounter, _  = meter.Int64Counter("gcreds4aws.proxy.hits", metric.WithDescription("Requests served by the local IMDS proxy, by path"))
+)
@@ -0,0 +1,350 @@
+package gcreds4aws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	regionPath      = "/latest/meta-data/placement/availability-zone"
+	credentialsPath = "/latest/meta-data/iam/security-credentials"
+	tokenPath       = "/latest/api/token"
+
+	tokenHeader    = "X-aws-ec2-metadata-token"
+	tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	minTokenTTL     = 1 * time.Second
+	maxTokenTTL     = 6 * time.Hour // matches the real IMDS limit of 21600s
+	defaultTokenTTL = 6 * time.Hour
+)
+
+// SetProxyBasePath configures the DefaultCredentialsManager's IMDS proxy
+// mount path.
+func SetProxyBasePath(path string) {
+	DefaultCredentialsManager.SetProxyBasePath(path)
+}
+
+// SetProxyBasePath mounts the IMDS proxy's routes under path instead of at
+// the root (e.g. "/internal" turns "/latest/api/token" into
+// "/internal/latest/api/token"). Must be called before the first
+// NewCredentialsOption call that starts the proxy. path is stored as given;
+// a leading slash is added if missing.
+func (mgr *CredentialsManager) SetProxyBasePath(path string) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if path != "" && path[0] != '/' {
+		path = "/" + path
+	}
+	mgr.proxyBasePath = path
+}
+
+// SetProxyAllowIMDSv1 configures the DefaultCredentialsManager's IMDS proxy
+// to also accept tokenless (IMDSv1-style) requests.
+func SetProxyAllowIMDSv1(allow bool) {
+	DefaultCredentialsManager.SetProxyAllowIMDSv1(allow)
+}
+
+// SetProxyAllowIMDSv1 opts the proxy into also serving requests that carry no
+// X-aws-ec2-metadata-token at all. The proxy requires a valid IMDSv2 token by
+// default specifically to close the localhost SSRF vector of any other local
+// process discovering the ephemeral port and reading credentials from it
+// without ever having to obtain a token first; only enable this for clients
+// that cannot be updated to call the token endpoint first.
+func (mgr *CredentialsManager) SetProxyAllowIMDSv1(allow bool) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.proxyAllowIMDSv1 = allow
+}
+
+// SetProxyUnixSocketPath configures the DefaultCredentialsManager's IMDS
+// proxy to bind a Unix domain socket at path instead of a TCP port.
+func SetProxyUnixSocketPath(path string) {
+	DefaultCredentialsManager.SetProxyUnixSocketPath(path)
+}
+
+// SetProxyUnixSocketPath binds the IMDS proxy to a Unix domain socket at
+// path instead of an ephemeral TCP port, so only processes with filesystem
+// access to the socket (not every local process that can guess the port)
+// can reach it. Since the oauth2 externalaccount AWS credential source only
+// ever does a plain net/http GET against CredentialSource.URL, which cannot
+// address a Unix socket, rewriteCredentialSource refuses to build a proxy
+// URL while this is set; pair it with SetAWSCredentialsSupplier instead, or
+// call ProxyHTTPClient to reach the socket directly.
+func (mgr *CredentialsManager) SetProxyUnixSocketPath(path string) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.proxyUnixSocketPath = path
+}
+
+// ProxyHTTPClient returns the DefaultCredentialsManager's proxy HTTP client.
+func ProxyHTTPClient() (*http.Client, error) {
+	return DefaultCredentialsManager.ProxyHTTPClient()
+}
+
+// ProxyHTTPClient starts the IMDS proxy if needed and returns an *http.Client
+// that can reach it. When SetProxyUnixSocketPath is set, the returned
+// client's Transport dials the Unix socket directly (any host in the request
+// URL is ignored); otherwise it is http.DefaultClient, since the proxy is
+// already reachable at a normal TCP address in that case.
+func (mgr *CredentialsManager) ProxyHTTPClient() (*http.Client, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.proxyUnixSocketPath == "" {
+		if err := mgr.startProxyServerLocked(); err != nil {
+			return nil, err
+		}
+		return http.DefaultClient, nil
+	}
+	if err := mgr.startProxyServerLocked(); err != nil {
+		return nil, err
+	}
+	socketPath := mgr.proxyUnixSocketPath
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}, nil
+}
+
+func (mgr *CredentialsManager) rewriteCredentialSource(cred *credentials) (*credentials, error) {
+	// check from AWS Credential Source
+	if cred.SubjectTokenType != SubjectTokenTypeForAWS {
+		return cred, nil
+	}
+	if cred.CredentialSource != nil && cred.CredentialSource.File != "" {
+		return cred, nil
+	}
+	if mgr.getProxyUnixSocketPath() != "" {
+		return nil, errors.New("proxy is configured with a Unix domain socket, which oauth2/externalaccount's AWS credential source cannot address by URL; use SetAWSCredentialsSupplier instead")
+	}
+
+	addr, err := mgr.getProxyServerAddress()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy server address: %w", err)
+	}
+	if cred.CredentialSource == nil {
+		cred.CredentialSource = &credentialSource{
+			EnvironmentID: "aws1",
+		}
+	}
+	basePath := mgr.getProxyBasePath()
+	cred.CredentialSource.URL = fmt.Sprintf("http://%s%s%s", addr, basePath, credentialsPath)
+	cred.CredentialSource.RegionURL = fmt.Sprintf("http://%s%s%s", addr, basePath, regionPath)
+	cred.CredentialSource.RegionalCredVerificationURL = "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15"
+	return cred, nil
+}
+
+func (mgr *CredentialsManager) getProxyBasePath() string {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.proxyBasePath
+}
+
+func (mgr *CredentialsManager) getProxyUnixSocketPath() string {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.proxyUnixSocketPath
+}
+
+func (mgr *CredentialsManager) getProxyServerAddress() (string, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if err := mgr.startProxyServerLocked(); err != nil {
+		return "", err
+	}
+	tcpAddr, ok := mgr.proxyListener.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", errors.New("proxy is bound to a Unix domain socket, which has no TCP address; use ProxyHTTPClient instead")
+	}
+	return fmt.Sprintf("127.0.0.1:%d", tcpAddr.Port), nil
+}
+
+// startProxyServerLocked lazily starts the proxy server, binding a Unix
+// domain socket at proxyUnixSocketPath if one is configured and an ephemeral
+// TCP port otherwise. Requires mgr.mu to already be held.
+func (mgr *CredentialsManager) startProxyServerLocked() error {
+	if mgr.proxyServer != nil {
+		return nil
+	}
+	var listener net.Listener
+	var err error
+	if mgr.proxyUnixSocketPath != "" {
+		if err := os.RemoveAll(mgr.proxyUnixSocketPath); err != nil {
+			return fmt.Errorf("failed to remove stale unix socket: %w", err)
+		}
+		listener, err = net.Listen("unix", mgr.proxyUnixSocketPath)
+	} else {
+		listener, err = net.Listen("tcp", ":0")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	mgr.proxyListener = listener
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		mgr.proxyRegion = region
+	} else if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		mgr.proxyRegion = region
+	} else {
+		mgr.proxyRegion = "us-east-1"
+	}
+	m := http.NewServeMux()
+	mgr.registerProxyRoutes(m)
+	mgr.proxyServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := mgr.getLogger()
+			logger.Debug("receive request on credentials proxy server", "method", r.Method, "url", r.URL, "remote_addr", r.RemoteAddr)
+			m.ServeHTTP(w, r)
+		}),
+	}
+	mgr.proxyWaitGroup = sync.WaitGroup{}
+	mgr.proxyWaitGroup.Add(1)
+	go func() {
+		logger := mgr.getLogger()
+		logger.Info("start credentials proxy server", "addr", listener.Addr())
+		if err := mgr.proxyServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("failed to serve credentials proxy server", "error", err)
+		}
+		mgr.proxyWaitGroup.Done()
+	}()
+	return nil
+}
+
+// registerProxyRoutes wires up the IMDSv1 and IMDSv2 routes under
+// mgr.proxyBasePath. Requires mgr.mu to already be held.
+func (mgr *CredentialsManager) registerProxyRoutes(m *http.ServeMux) {
+	base := mgr.proxyBasePath
+	m.HandleFunc(base+tokenPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ttl := defaultTokenTTL
+		if raw := r.Header.Get(tokenTTLHeader); raw != "" {
+			seconds, err := strconv.Atoi(raw)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ttl = time.Duration(seconds) * time.Second
+			if ttl < minTokenTTL || ttl > maxTokenTTL {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		token, err := mgr.issueIMDSToken(ttl)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(tokenTTLHeader, strconv.Itoa(int(ttl.Seconds())))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(token))
+	})
+	m.HandleFunc(base+regionPath, func(w http.ResponseWriter, r *http.Request) {
+		if !mgr.checkIMDSToken(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		proxyHitCounter.Add(r.Context(), 1, metric.WithAttributes(attribute.String("path", regionPath)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mgr.proxyRegion))
+	})
+	m.HandleFunc(base+credentialsPath, func(w http.ResponseWriter, r *http.Request) {
+		if !mgr.checkIMDSToken(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		proxyHitCounter.Add(r.Context(), 1, metric.WithAttributes(attribute.String("path", credentialsPath)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("default"))
+	})
+	m.HandleFunc(base+credentialsPath+"/default", func(w http.ResponseWriter, r *http.Request) {
+		if !mgr.checkIMDSToken(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		proxyHitCounter.Add(r.Context(), 1, metric.WithAttributes(attribute.String("path", credentialsPath+"/default")))
+		w.Header().Set("Content-Type", "application/json")
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+		awsCfg, err := mgr.loadConfig(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"Code": "Failed", "Message": "%s"}`, err.Error())
+			return
+		}
+		cloned := awsCfg.Copy()
+		cloned.Region = mgr.proxyRegion
+		cred, err := cloned.Credentials.Retrieve(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"Code": "Failed", "Message": "%s"}`, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w,
+			`{"Code": "Success", "LastUpdated":"%s", "Type": "AWS-HMAC", "AccessKeyId": "%s", "SecretAccessKey": "%s", "Token": "%s", "Expiration": "%s"}`,
+			time.Now().Format(time.RFC3339),
+			cred.AccessKeyID,
+			cred.SecretAccessKey,
+			cred.SessionToken,
+			cred.Expires.Format(time.RFC3339),
+		)
+	})
+}
+
+// issueIMDSToken mints an opaque IMDSv2 session token good for ttl.
+func (mgr *CredentialsManager) issueIMDSToken(ttl time.Duration) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.imdsTokens == nil {
+		mgr.imdsTokens = make(map[string]time.Time)
+	}
+	for t, expiresAt := range mgr.imdsTokens {
+		if expiresAt.Before(time.Now()) {
+			delete(mgr.imdsTokens, t)
+		}
+	}
+	mgr.imdsTokens[token] = time.Now().Add(ttl)
+	return token, nil
+}
+
+// checkIMDSToken reports whether r carries a valid, unexpired IMDSv2 session
+// token. Requests with no token are rejected by default, since accepting them
+// would reopen the localhost SSRF vector the token requirement exists to
+// close; pass SetProxyAllowIMDSv1(true) to accept tokenless requests anyway.
+func (mgr *CredentialsManager) checkIMDSToken(r *http.Request) bool {
+	token := r.Header.Get(tokenHeader)
+	if token == "" {
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+		return mgr.proxyAllowIMDSv1
+	}
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	expiresAt, ok := mgr.imdsTokens[token]
+	if !ok {
+		return false
+	}
+	return expiresAt.After(time.Now())
+}
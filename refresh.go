@@ -0,0 +1,124 @@
+package gcreds4aws
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// defaultRefreshWindow is how far ahead of expiry the background refresher
+// tries to fetch replacement credentials. 60s leaves headroom for the
+// credential lookup (e.g. an SSM or Secrets Manager call) well before a caller
+// would otherwise block on an expired cache entry. The refresh does not
+// perform the STS exchange or impersonation itself.
+const defaultRefreshWindow = 60 * time.Second
+
+// refreshJitterFraction caps the random jitter added to each refresh delay at
+// this fraction of the configured refresh window, so a flat jitter constant
+// can't dominate (or blow past) a short window an operator configured on
+// purpose.
+const refreshJitterFraction = 0.1
+
+// SetRefreshWindow configures the DefaultCredentialsManager's refresh window.
+func SetRefreshWindow(d time.Duration) {
+	DefaultCredentialsManager.SetRefreshWindow(d)
+}
+
+// SetRefreshWindow sets how far ahead of cache expiry the background
+// refresher proactively re-fetches credentials.
+func (mgr *CredentialsManager) SetRefreshWindow(d time.Duration) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.refreshWindow = d
+}
+
+func (mgr *CredentialsManager) getRefreshWindow() time.Duration {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	if mgr.refreshWindow <= 0 {
+		return defaultRefreshWindow
+	}
+	return mgr.refreshWindow
+}
+
+// SetMaxCacheLifetime configures the DefaultCredentialsManager's cache lifetime.
+func SetMaxCacheLifetime(d time.Duration) {
+	DefaultCredentialsManager.SetMaxCacheLifetime(d)
+}
+
+// SetMaxCacheLifetime overrides CacheLifetimeSeconds for this manager,
+// letting callers trade off refresh frequency against STS rate limits.
+func (mgr *CredentialsManager) SetMaxCacheLifetime(d time.Duration) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.maxCacheLifetime = d
+}
+
+func (mgr *CredentialsManager) getMaxCacheLifetime() time.Duration {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.getMaxCacheLifetimeLocked()
+}
+
+// getMaxCacheLifetimeLocked requires mgr.mu to already be held.
+func (mgr *CredentialsManager) getMaxCacheLifetimeLocked() time.Duration {
+	if mgr.maxCacheLifetime <= 0 {
+		return CacheLifetimeSeconds * time.Second
+	}
+	return mgr.maxCacheLifetime
+}
+
+// startBackgroundRefresher lazily starts the goroutine that keeps
+// cacheCredentials warm ahead of expiry. It is safe to call repeatedly; only
+// the first call since the manager was created or last closed starts the
+// goroutine.
+func (mgr *CredentialsManager) startBackgroundRefresher() {
+	mgr.mu.Lock()
+	if mgr.refreshStop != nil {
+		mgr.mu.Unlock()
+		return
+	}
+	mgr.refreshStop = make(chan struct{})
+	stop := mgr.refreshStop
+	mgr.mu.Unlock()
+	go mgr.runBackgroundRefresher(stop)
+}
+
+func (mgr *CredentialsManager) runBackgroundRefresher(stop chan struct{}) {
+	logger := mgr.getLogger()
+	for {
+		select {
+		case <-time.After(mgr.nextRefreshDelay()):
+		case <-stop:
+			return
+		}
+		// Must bypass the cache check: cacheCredentialsExpiresAt hasn't passed
+		// yet at this point (that's the whole point of refreshing ahead of
+		// it), so fetchCredentialsOption would just return the still-valid
+		// cached entry and this loop would never actually refresh anything.
+		if _, err := mgr.resolveCredentialsOption(context.Background()); err != nil {
+			logger.Error("failed to proactively refresh credentials, keeping last-good value", "error", err)
+		} else {
+			logger.Debug("proactively refreshed credentials in background")
+		}
+	}
+}
+
+// nextRefreshDelay returns how long to wait before the next proactive
+// refresh attempt, randomized so that many processes sharing a cache
+// lifetime don't all hit STS at the same instant.
+func (mgr *CredentialsManager) nextRefreshDelay() time.Duration {
+	mgr.mu.Lock()
+	expiresAt := mgr.cacheCredentialsExpiresAt
+	mgr.mu.Unlock()
+	window := mgr.getRefreshWindow()
+	delay := time.Until(expiresAt.Add(-window))
+	if delay < 0 {
+		delay = 0
+	}
+	jitter := time.Duration(float64(window) * refreshJitterFraction)
+	if jitter <= 0 {
+		return delay
+	}
+	return delay + time.Duration(rand.Int63n(int64(jitter)))
+}
@@ -0,0 +1,90 @@
+package gcreds4aws
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2/google/externalaccount"
+	"google.golang.org/api/option"
+)
+
+// AWSCredentialsSupplierFunc resolves AWS security credentials and the AWS
+// region to embed in the `external_account` subject token, synchronously and
+// in-process. It is the programmatic alternative to rewriteCredentialSource's
+// localhost IMDS proxy: callers that already hold an aws.CredentialsProvider
+// (SSO, IRSA, assume-role chains, ...) can plug it in directly instead of
+// standing up a listener, which matters in Lambda/Fargate and other
+// read-only-FS or high-concurrency environments.
+type AWSCredentialsSupplierFunc func(ctx context.Context) (accessKeyID, secretAccessKey, sessionToken, region string, err error)
+
+// SetAWSCredentialsSupplier configures fn on the DefaultCredentialsManager.
+func SetAWSCredentialsSupplier(fn AWSCredentialsSupplierFunc) {
+	DefaultCredentialsManager.SetAWSCredentialsSupplier(fn)
+}
+
+// SetAWSCredentialsSupplier registers fn as the source of AWS security
+// credentials for subject token generation. When set, NewCredentialsOption
+// builds the external_account credential via externalaccount.NewTokenSource
+// instead of rewriting CredentialSource.URL to point at the IMDS proxy.
+func (mgr *CredentialsManager) SetAWSCredentialsSupplier(fn AWSCredentialsSupplierFunc) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.awsCredentialsSupplier = fn
+}
+
+func (mgr *CredentialsManager) hasAWSCredentialsSupplier() bool {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.awsCredentialsSupplier != nil
+}
+
+// getAWSCredentialsSupplier returns the configured supplier. Every call site
+// already gates on hasAWSCredentialsSupplier, so this never needs a fallback.
+func (mgr *CredentialsManager) getAWSCredentialsSupplier() AWSCredentialsSupplierFunc {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	return mgr.awsCredentialsSupplier
+}
+
+// awsSecurityCredentialsSupplier adapts the manager's AWSCredentialsSupplierFunc
+// to externalaccount.AwsSecurityCredentialsSupplier.
+type awsSecurityCredentialsSupplier struct {
+	mgr *CredentialsManager
+}
+
+func (s *awsSecurityCredentialsSupplier) AwsRegion(ctx context.Context, _ externalaccount.SupplierOptions) (string, error) {
+	_, _, _, region, err := s.mgr.getAWSCredentialsSupplier()(ctx)
+	return region, err
+}
+
+func (s *awsSecurityCredentialsSupplier) AwsSecurityCredentials(ctx context.Context, _ externalaccount.SupplierOptions) (*externalaccount.AwsSecurityCredentials, error) {
+	accessKeyID, secretAccessKey, sessionToken, _, err := s.mgr.getAWSCredentialsSupplier()(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &externalaccount.AwsSecurityCredentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+	}, nil
+}
+
+// newCredentialsOptionFromSupplier builds the external_account token source
+// directly from the configured AWS credentials supplier, bypassing the IMDS
+// proxy entirely: no listener is started and no credentials ever cross
+// localhost.
+func (mgr *CredentialsManager) newCredentialsOptionFromSupplier(ctx context.Context, cred *credentials) (option.ClientOption, error) {
+	cfg := externalaccount.Config{
+		Audience:                       cred.Audience,
+		SubjectTokenType:               cred.SubjectTokenType,
+		TokenURL:                       cred.TokenURL,
+		ServiceAccountImpersonationURL: cred.ServiceAccountImpersonationURL,
+		WorkforcePoolUserProject:       cred.WorkforcePoolUserProject,
+		AwsSecurityCredentialsSupplier: &awsSecurityCredentialsSupplier{mgr: mgr},
+	}
+	ts, err := externalaccount.NewTokenSource(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create external account token source: %w", err)
+	}
+	return option.WithTokenSource(ts), nil
+}
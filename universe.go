@@ -0,0 +1,83 @@
+package gcreds4aws
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"google.golang.org/api/option"
+)
+
+// defaultUniverseDomain is the public Google Cloud universe. Trusted Partner
+// Cloud and sovereign-region deployments run their own universe, reachable
+// at equivalent hostnames under a different suffix (e.g. sts.<universe>).
+const defaultUniverseDomain = "googleapis.com"
+
+// SetUniverseDomain configures the DefaultCredentialsManager's universe domain.
+func SetUniverseDomain(domain string) {
+	DefaultCredentialsManager.SetUniverseDomain(domain)
+}
+
+// SetUniverseDomain overrides the Google Cloud universe that STS, IAM
+// Credentials, and the eventual downstream SDK client target. It defaults to
+// "googleapis.com" or the GOOGLE_CLOUD_UNIVERSE_DOMAIN environment variable.
+func (mgr *CredentialsManager) SetUniverseDomain(domain string) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+	mgr.universeDomain = domain
+}
+
+func (mgr *CredentialsManager) getUniverseDomain() string {
+	mgr.mu.Lock()
+	domain := mgr.universeDomain
+	mgr.mu.Unlock()
+	if domain != "" {
+		return domain
+	}
+	if domain := os.Getenv("GOOGLE_CLOUD_UNIVERSE_DOMAIN"); domain != "" {
+		return domain
+	}
+	return defaultUniverseDomain
+}
+
+func (mgr *CredentialsManager) stsTokenURL() string {
+	return fmt.Sprintf("https://sts.%s/v1/token", mgr.getUniverseDomain())
+}
+
+func (mgr *CredentialsManager) serviceAccountImpersonationURL(email string) string {
+	return fmt.Sprintf("https://iamcredentials.%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", mgr.getUniverseDomain(), email)
+}
+
+// NewCredentialsOptions returns NewCredentialsOption's result together with
+// an option.WithUniverseDomain option, so downstream Google SDK calls target
+// the configured universe instead of the default googleapis.com.
+func NewCredentialsOptions(ctx context.Context) ([]option.ClientOption, error) {
+	return DefaultCredentialsManager.NewCredentialsOptions(ctx)
+}
+
+// NewCredentialsOptions is the universe-aware counterpart to
+// NewCredentialsOption. option.ClientOption implementations can't be
+// composed outside the google.golang.org/api/option package, so unlike
+// NewCredentialsOption (which only ever returns the credentials option),
+// this returns every option.ClientOption a caller needs to pass to a Google
+// SDK client constructor.
+func (mgr *CredentialsManager) NewCredentialsOptions(ctx context.Context) ([]option.ClientOption, error) {
+	credOpt, err := mgr.NewCredentialsOption(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{credOpt, option.WithUniverseDomain(mgr.getUniverseDomain())}, nil
+}
+
+// WithCredentialsOptions is the universe-aware counterpart to WithCredentials.
+func WithCredentialsOptions(ctx context.Context) []option.ClientOption {
+	return DefaultCredentialsManager.WithCredentialsOptions(ctx)
+}
+
+func (mgr *CredentialsManager) WithCredentialsOptions(ctx context.Context) []option.ClientOption {
+	opts, err := mgr.NewCredentialsOptions(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return opts
+}
@@ -0,0 +1,42 @@
+package gcreds4aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/api/option"
+)
+
+// newWorkforceCredentialsOption builds an external_account credential for a
+// workforce identity pool (as opposed to a workload identity pool), so
+// operators can federate human/CI identities from AWS-hosted CI into GCP
+// without hand-crafting the credentials JSON. It is reached from
+// NewCredentialsOption whenever GOOGLE_CLOUD_WORKFORCE_POOL_ID is set, and
+// still uses the AWS4 subject token type, so it shares rewriteCredentialSource
+// and the AWS credentials supplier with the workload pool path.
+func (mgr *CredentialsManager) newWorkforceCredentialsOption(ctx context.Context, workforcePoolID string) (option.ClientOption, error) {
+	providerID := os.Getenv("GOOGLE_CLOUD_WORKFORCE_PROVIDER_ID")
+	if providerID == "" {
+		return nil, errors.New("GOOGLE_CLOUD_WORKFORCE_PROVIDER_ID is required when GOOGLE_CLOUD_WORKFORCE_POOL_ID is set")
+	}
+
+	cred := &credentials{
+		Type:                     "external_account",
+		Audience:                 fmt.Sprintf("//iam.%s/locations/global/workforcePools/%s/providers/%s", mgr.getUniverseDomain(), workforcePoolID, providerID),
+		SubjectTokenType:         SubjectTokenTypeForAWS,
+		TokenURL:                 mgr.stsTokenURL(),
+		WorkforcePoolUserProject: os.Getenv("GOOGLE_CLOUD_WORKFORCE_POOL_USER_PROJECT"),
+	}
+	if serviceAccountEmail := os.Getenv("GOOGLE_CLOUD_SERVICE_ACCOUNT_EMAIL"); serviceAccountEmail != "" {
+		cred.ServiceAccountImpersonationURL = mgr.serviceAccountImpersonationURL(serviceAccountEmail)
+	}
+
+	bs, err := json.Marshal(cred)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+	return mgr.newCredentialsOptionFromBytes(ctx, bs)
+}